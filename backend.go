@@ -0,0 +1,28 @@
+package giftp
+
+import (
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// Backend supplies the *git.Repository a GitDriverFactory serves.
+// Swapping the Backend is how giftp can serve a plain local checkout, an
+// in-memory repository, or one cloned from a remote on startup, without
+// GitDriver itself knowing the difference.
+type Backend interface {
+	// Open returns the repository to serve; GitDriver reads its worktree
+	// filesystem straight off r.Worktree().Filesystem, so Open needn't
+	// return one separately. Called once per factory, the first time a
+	// driver is built from it.
+	Open() (r *git.Repository, err error)
+	// Sync is called by GitDriver after every local commit so a backend
+	// with its own notion of "upstream" (e.g. backend/clone) can push
+	// back. Skipped when the factory also has a PushMode configured
+	// AND the backend implements remoteNamer reporting the same remote
+	// PushMode already pushed to, so the same commit isn't pushed
+	// twice. Backends with nothing to sync, like backend/plain and
+	// backend/memory, make it a no-op regardless.
+	Sync() error
+	// Close releases any resources Open acquired (temp directories,
+	// clone handles, ...).
+	Close() error
+}
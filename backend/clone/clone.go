@@ -0,0 +1,89 @@
+// Package clone implements a giftp.Backend that clones a remote on
+// startup and pushes local commits back to it, so giftp can serve a
+// remote git host without any pre-provisioned local checkout.
+package clone
+
+import (
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// Backend clones URL once on Open and pushes back to it from Sync.
+type Backend struct {
+	URL        string
+	Auth       transport.AuthMethod
+	RemoteName string
+	// UseMemory clones into an in-memory filesystem/storer instead of a
+	// temp directory on disk.
+	UseMemory bool
+
+	repo    *git.Repository
+	tempDir string
+}
+
+// New returns a Backend that clones url, authenticating with auth if set.
+func New(url string, auth transport.AuthMethod) *Backend {
+	return &Backend{URL: url, Auth: auth}
+}
+
+func (b *Backend) remoteName() string {
+	if b.RemoteName == "" {
+		return "origin"
+	}
+	return b.RemoteName
+}
+
+// SyncRemoteName reports the remote Sync pushes to, so giftp can tell
+// whether a factory-level remote sync (GitDriverFactory.RemoteName)
+// already covers it.
+func (b *Backend) SyncRemoteName() string {
+	return b.remoteName()
+}
+
+func (b *Backend) Open() (*git.Repository, error) {
+	if b.UseMemory {
+		r, err := git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{URL: b.URL, Auth: b.Auth, RemoteName: b.remoteName()})
+		if err != nil {
+			return nil, err
+		}
+		b.repo = r
+		return r, nil
+	}
+
+	dir, err := ioutil.TempDir("", "giftp-clone")
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := git.PlainClone(dir, false, &git.CloneOptions{URL: b.URL, Auth: b.Auth, RemoteName: b.remoteName()})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	b.repo = r
+	b.tempDir = dir
+	return r, nil
+}
+
+// Sync pushes local commits back to the cloned remote.
+func (b *Backend) Sync() error {
+	err := b.repo.Push(&git.PushOptions{RemoteName: b.remoteName(), Auth: b.Auth})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// Close removes the temp directory the clone checked out into, if any.
+func (b *Backend) Close() error {
+	if b.tempDir == "" {
+		return nil
+	}
+	return os.RemoveAll(b.tempDir)
+}
@@ -0,0 +1,30 @@
+// Package memory implements a giftp.Backend that keeps the repository
+// entirely in memory, useful for tests and ephemeral FTP dropboxes that
+// shouldn't leave anything on disk.
+package memory
+
+import (
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// Backend serves a fresh, empty in-memory repository each time it's
+// opened; nothing persists once the process exits.
+type Backend struct{}
+
+// New returns a Backend that initializes a new in-memory repository.
+func New() *Backend {
+	return &Backend{}
+}
+
+func (b *Backend) Open() (*git.Repository, error) {
+	return git.Init(memory.NewStorage(), memfs.New())
+}
+
+// Sync is a no-op: there is no upstream for a purely in-memory repository.
+func (b *Backend) Sync() error { return nil }
+
+// Close is a no-op: the in-memory storage is garbage collected with the
+// Backend itself.
+func (b *Backend) Close() error { return nil }
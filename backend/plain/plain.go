@@ -0,0 +1,28 @@
+// Package plain implements a giftp.Backend backed by an ordinary local
+// git checkout, the same way GitDriver worked before backends existed.
+package plain
+
+import (
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// Backend opens a pre-existing checkout at RootPath.
+type Backend struct {
+	RootPath string
+}
+
+// New returns a Backend serving the git checkout at rootPath.
+func New(rootPath string) *Backend {
+	return &Backend{RootPath: rootPath}
+}
+
+func (b *Backend) Open() (*git.Repository, error) {
+	return git.PlainOpen(b.RootPath)
+}
+
+// Sync is a no-op: a plain checkout has no upstream of its own to push
+// to beyond what GitDriverFactory's remote sync already handles.
+func (b *Backend) Sync() error { return nil }
+
+// Close is a no-op: the checkout on disk outlives the driver.
+func (b *Backend) Close() error { return nil }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 
 	"github.com/goftp/server"
@@ -10,22 +11,32 @@ import (
 
 func main() {
 	var (
-		root = flag.String("root", "", "Root directory to serve")
-		user = flag.String("user", "admin", "Username for login")
-		pass = flag.String("pass", "123456", "Password for login")
-		port = flag.Int("port", 2121, "Port")
-		host = flag.String("host", "localhost", "Port")
+		root       = flag.String("root", "", "Root directory to serve")
+		user       = flag.String("user", "admin", "Username for login")
+		pass       = flag.String("pass", "123456", "Password for login")
+		port       = flag.Int("port", 2121, "Port")
+		host       = flag.String("host", "localhost", "Host")
+		remote     = flag.String("remote", "origin", "Git remote to sync with")
+		pushMode   = flag.String("push-mode", "off", "Remote push mode: off, sync, async")
+		sshKeyPath = flag.String("ssh-key", "", "SSH private key used to authenticate with the remote")
+		httpsToken = flag.String("https-token", "", "HTTPS token used to authenticate with the remote")
 	)
 	flag.Parse()
 	if *root == "" {
 		log.Fatalf("Please set a root to serve with -root")
 	}
 
-	factory := &gitdriver.GitDriverFactory{
-		RootPath: *root,
-		Perm:     server.NewSimplePerm("user", "group"),
+	mode, err := parsePushMode(*pushMode)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	factory := gitdriver.NewGitDriverFactory(*root, server.NewSimplePerm("user", "group"))
+	factory.RemoteName = *remote
+	factory.PushMode = mode
+	factory.SSHKeyPath = *sshKeyPath
+	factory.HTTPSToken = *httpsToken
+
 	opts := &server.ServerOpts{
 		Factory:  factory,
 		Port:     *port,
@@ -36,8 +47,20 @@ func main() {
 	log.Printf("Starting ftp server on %v:%v", opts.Hostname, opts.Port)
 	log.Printf("Username %v, Password %v", *user, *pass)
 	server := server.NewServer(opts)
-	err := server.ListenAndServe()
-	if err != nil {
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatal("Error starting server:", err)
 	}
 }
+
+func parsePushMode(mode string) (gitdriver.PushMode, error) {
+	switch mode {
+	case "off", "":
+		return gitdriver.PushOff, nil
+	case "sync":
+		return gitdriver.PushSync, nil
+	case "async":
+		return gitdriver.PushAsync, nil
+	default:
+		return gitdriver.PushOff, fmt.Errorf("unknown -push-mode %q (want off, sync or async)", mode)
+	}
+}
@@ -4,19 +4,56 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/goftp/server"
+	"github.com/mochja/giftp/backend/plain"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
-	"time"
 )
 
+// CommitAuthorResolver maps an authenticated FTP username to the git
+// signature that should be recorded as the author of the commits it
+// produces. Factories that don't care about per-user attribution can
+// leave this nil, in which case a generic signature is used.
+type CommitAuthorResolver func(user string) *object.Signature
+
+// GitDriver commits every mutating FTP command individually; there is no
+// batched or per-session commit mode.
+//
+// giftp#chunk0-5 asked for a mode that groups a whole FTP session's
+// changes into one commit, committing on disconnect or an explicit SITE
+// COMMIT/ABORT. That isn't implementable against goftp/server as
+// this package uses it: its Driver interface declares neither a teardown hook
+// nor a way to receive SITE subcommands beyond the built-in CHMOD/UMASK,
+// so there is no signal this driver can use to know a session ended or
+// to react to SITE COMMIT/ABORT. Delivering it for real would mean
+// forking or wrapping goftp/server to add that signal, which is out of
+// scope here. Tracked as won't-do until such a fork exists.
 type GitDriver struct {
-	RootPath string
 	server.Perm
+
+	CommitAuthorResolver CommitAuthorResolver
+
+	// backend supplied repo, shared with every other driver the same
+	// factory manufactures. mu guards it so concurrent FTP sessions
+	// can't corrupt the index.
+	backend Backend
+	repo    *git.Repository
+	mu      *sync.RWMutex
+
+	// sync mirrors commits to a remote and keeps the repo fresh on
+	// Init; nil when the factory was built without remote config.
+	sync *remoteSync
+
+	// username is the FTP identity captured in Init and used to
+	// attribute commits and render the default commit message.
+	username string
 }
 
 type FileInfo struct {
@@ -39,19 +76,44 @@ func (f *FileInfo) Group() string {
 	return f.group
 }
 
-func (driver *GitDriver) realPath(path string) string {
-	paths := strings.Split(path, "/")
-	return filepath.Join(append([]string{driver.RootPath}, paths...)...)
+func (driver *GitDriver) Init(conn *server.Conn) {
+	driver.username = conn.LoginUser()
 }
 
-func (driver *GitDriver) Init(conn *server.Conn) {
+// takeCommitMessage returns a templated default commit message
+// describing op and the path it acted on.
+//
+// giftp#chunk0-1 also asked for clients to stage a custom message via
+// "SITE MSG <text>" before the next commit. That half of the request is
+// won't-do for the same reason as giftp#chunk0-5: goftp/server's
+// built-in SITE handling only recognizes CHMOD and UMASK and never
+// dispatches other subcommands (including MSG) to the driver, so there
+// is no way for an FTP client to actually reach this. Only the
+// per-user attribution half (CommitAuthorResolver) and this templated
+// default message were deliverable.
+func (driver *GitDriver) takeCommitMessage(op, path string) string {
+	if path == "" {
+		return fmt.Sprintf("giftp: %s by %s", op, driver.username)
+	}
+	return fmt.Sprintf("giftp: %s %s by %s", op, path, driver.username)
 }
 
 func (driver *GitDriver) ChangeDir(path string) error {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return err
+	driver.mu.RLock()
+	defer driver.mu.RUnlock()
+	r := driver.repo
+
+	if isVirtualPath(path) {
+		info, err := virtualStat(r, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return errors.New("Not a directory")
 	}
+
 	tree, err := r.Worktree()
 	if err != nil {
 		return err
@@ -68,10 +130,14 @@ func (driver *GitDriver) ChangeDir(path string) error {
 }
 
 func (driver *GitDriver) Stat(path string) (server.FileInfo, error) {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return nil, err
+	driver.mu.RLock()
+	defer driver.mu.RUnlock()
+	r := driver.repo
+
+	if isVirtualPath(path) {
+		return virtualStat(r, path)
 	}
+
 	tree, err := r.Worktree()
 	if err != nil {
 		return nil, err
@@ -101,9 +167,12 @@ func (driver *GitDriver) Stat(path string) (server.FileInfo, error) {
 }
 
 func (driver *GitDriver) ListDir(path string, callback func(server.FileInfo) error) error {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return err
+	driver.mu.RLock()
+	defer driver.mu.RUnlock()
+	r := driver.repo
+
+	if isVirtualPath(path) {
+		return virtualListDir(r, path, callback)
 	}
 
 	tree, err := r.Worktree()
@@ -116,6 +185,14 @@ func (driver *GitDriver) ListDir(path string, callback func(server.FileInfo) err
 		return err
 	}
 
+	if strings.Trim(path, "/") == "" {
+		for _, root := range vfsRoots {
+			if err := callback(virtualDirInfo(root)); err != nil {
+				return err
+			}
+		}
+	}
+
 	paths := strings.Split(path, "/")
 
 	for _, file := range files {
@@ -150,124 +227,150 @@ func (driver *GitDriver) ListDir(path string, callback func(server.FileInfo) err
 }
 
 func (driver *GitDriver) DeleteDir(path string) error {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return err
-	}
-	tree, err := r.Worktree()
-	if err != nil {
-		return err
+	if isVirtualPath(path) {
+		return errReadOnlyHistory(path)
 	}
 
-	f, err := tree.Filesystem.Lstat(path)
-	if err != nil {
-		return err
-	}
+	r, err := driver.withWriteLock(func(r *git.Repository) error {
+		tree, err := r.Worktree()
+		if err != nil {
+			return err
+		}
 
-	if !f.IsDir() {
-		return errors.New("Not a directory")
-	}
+		f, err := tree.Filesystem.Lstat(path)
+		if err != nil {
+			return err
+		}
 
-	err = tree.Filesystem.Remove(path)
-	if err != nil {
-		return err
-	}
+		if !f.IsDir() {
+			return errors.New("Not a directory")
+		}
+
+		if err := tree.Filesystem.Remove(path); err != nil {
+			return err
+		}
+
+		if err := driver.add(path, r); err != nil {
+			return err
+		}
 
-	err = driver.add(path, r)
+		return driver.commit(r, "rmdir", path)
+	})
 	if err != nil {
 		return err
 	}
 
-	return driver.commit(r)
+	return driver.syncAfterCommit(r)
 }
 
 func (driver *GitDriver) DeleteFile(path string) error {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return err
-	}
-	tree, err := r.Worktree()
-	if err != nil {
-		return err
+	if isVirtualPath(path) {
+		return errReadOnlyHistory(path)
 	}
 
-	f, err := tree.Filesystem.Lstat(path)
-	if err != nil {
-		return err
-	}
+	r, err := driver.withWriteLock(func(r *git.Repository) error {
+		tree, err := r.Worktree()
+		if err != nil {
+			return err
+		}
 
-	if f.IsDir() {
-		return errors.New("Not a file")
-	}
+		f, err := tree.Filesystem.Lstat(path)
+		if err != nil {
+			return err
+		}
 
-	err = tree.Filesystem.Remove(path)
-	if err != nil {
-		return err
-	}
+		if f.IsDir() {
+			return errors.New("Not a file")
+		}
 
-	err = driver.add(path, r)
+		if err := tree.Filesystem.Remove(path); err != nil {
+			return err
+		}
+
+		if err := driver.add(path, r); err != nil {
+			return err
+		}
+
+		return driver.commit(r, "delete", path)
+	})
 	if err != nil {
 		return err
 	}
 
-	return driver.commit(r)
+	return driver.syncAfterCommit(r)
 }
 
 func (driver *GitDriver) Rename(fromPath string, toPath string) error {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return err
+	if isVirtualPath(fromPath) {
+		return errReadOnlyHistory(fromPath)
 	}
-	tree, err := r.Worktree()
-	if err != nil {
-		return err
+	if isVirtualPath(toPath) {
+		return errReadOnlyHistory(toPath)
 	}
 
-	err = tree.Filesystem.Rename(fromPath, toPath)
-	if err != nil {
-		return err
-	}
+	r, err := driver.withWriteLock(func(r *git.Repository) error {
+		tree, err := r.Worktree()
+		if err != nil {
+			return err
+		}
 
-	err = driver.add(fromPath, r)
-	if err != nil {
-		return err
-	}
-	err = driver.add(toPath, r)
+		if err := tree.Filesystem.Rename(fromPath, toPath); err != nil {
+			return err
+		}
+
+		if err := driver.add(fromPath, r); err != nil {
+			return err
+		}
+		if err := driver.add(toPath, r); err != nil {
+			return err
+		}
+
+		return driver.commit(r, "rename", fmt.Sprintf("%s -> %s", fromPath, toPath))
+	})
 	if err != nil {
 		return err
 	}
 
-	return driver.commit(r)
+	return driver.syncAfterCommit(r)
 }
 
 func (driver *GitDriver) MakeDir(path string) error {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return err
-	}
-	tree, err := r.Worktree()
-	if err != nil {
-		return err
+	if isVirtualPath(path) {
+		return errReadOnlyHistory(path)
 	}
 
-	err = tree.Filesystem.MkdirAll(path, os.ModePerm)
-	if err != nil {
-		return err
-	}
+	r, err := driver.withWriteLock(func(r *git.Repository) error {
+		tree, err := r.Worktree()
+		if err != nil {
+			return err
+		}
 
-	err = driver.add(path, r)
+		if err := tree.Filesystem.MkdirAll(path, os.ModePerm); err != nil {
+			return err
+		}
+
+		if err := driver.add(path, r); err != nil {
+			return err
+		}
+
+		return driver.commit(r, "mkdir", path)
+	})
 	if err != nil {
 		return err
 	}
 
-	return driver.commit(r)
+	return driver.syncAfterCommit(r)
 }
 
 func (driver *GitDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return 0, nil, err
+	driver.mu.RLock()
+	defer driver.mu.RUnlock()
+	r := driver.repo
+
+	if isVirtualPath(path) {
+		return virtualGetFile(r, path, offset)
 	}
+
 	tree, err := r.Worktree()
 	if err != nil {
 		return 0, nil, err
@@ -288,6 +391,20 @@ func (driver *GitDriver) GetFile(path string, offset int64) (int64, io.ReadClose
 	return info.Size(), f, nil
 }
 
+// withWriteLock runs fn with driver.mu held for writing against the
+// shared repo, then returns it so the caller can sync to a remote after
+// releasing the lock instead of holding it for however long that takes.
+func (driver *GitDriver) withWriteLock(fn func(r *git.Repository) error) (*git.Repository, error) {
+	driver.mu.Lock()
+	defer driver.mu.Unlock()
+	r := driver.repo
+	if err := fn(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// add stages destPath. Callers must already hold driver.mu for writing.
 func (driver *GitDriver) add(destPath string, r *git.Repository) error {
 	tree, err := r.Worktree()
 	if err != nil {
@@ -307,119 +424,256 @@ func (driver *GitDriver) add(destPath string, r *git.Repository) error {
 	return nil
 }
 
-func (driver *GitDriver) commit(r *git.Repository) error {
+// commit records a commit for op performed against path, attributing it
+// to the signature resolved for the current FTP user (or a generic
+// fallback signature if no CommitAuthorResolver was configured) and
+// using a templated default message. It only commits locally; syncing
+// to a remote happens in syncAfterCommit, once the caller has released
+// driver.mu. Callers must already hold driver.mu for writing.
+func (driver *GitDriver) commit(r *git.Repository, op, path string) error {
 	tree, err := r.Worktree()
 	if err != nil {
 		return err
 	}
 
-	_, err = tree.Commit("example go-git commit", &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "John Doe",
-			Email: "john@doe.org",
-			When:  time.Now(),
-		},
+	_, err = tree.Commit(driver.takeCommitMessage(op, path), &git.CommitOptions{
+		Author: driver.resolveAuthor(),
 	})
-	if err != nil {
-		return err
+	return err
+}
+
+// remoteNamer is implemented by backends that push to a remote of their
+// own (e.g. backend/clone), so syncAfterCommit can tell whether that
+// remote is the one a configured PushMode already pushed to.
+type remoteNamer interface {
+	SyncRemoteName() string
+}
+
+// syncAfterCommit pushes a just-made commit to whatever this driver is
+// configured to sync with. A factory-level remoteSync (PushMode) is
+// skipped as redundant with the backend's own Sync only when the
+// backend reports (via remoteNamer) that it pushes to the same remote
+// giftp#chunk0-6 described backend/clone plus PushSync as double-pushing
+// to; if the backend doesn't implement remoteNamer, or names a
+// different remote (e.g. a clone's origin vs. a GitDriverFactory.
+// RemoteName pointing elsewhere), both run, since they're no longer the
+// same push. Backends with no upstream of their own (backend/plain,
+// backend/memory) make Sync a no-op regardless. Callers must call this
+// only after releasing driver.mu: pushing can block on a slow or
+// unreachable remote for several seconds of retry backoff, and holding
+// the write lock for that long would stall every other FTP session
+// sharing this repo.
+func (driver *GitDriver) syncAfterCommit(r *git.Repository) error {
+	if driver.sync != nil {
+		if err := driver.sync.afterCommit(r); err != nil {
+			return err
+		}
+		if rn, ok := driver.backend.(remoteNamer); ok && rn.SyncRemoteName() == driver.sync.remoteName {
+			return nil
+		}
 	}
 
+	if err := driver.backend.Sync(); err != nil {
+		return fmt.Errorf("giftp: backend sync: %w", err)
+	}
 	return nil
 }
 
-func (driver *GitDriver) PutFile(destPath string, data io.Reader, appendData bool) (int64, error) {
-	r, err := git.PlainOpen(driver.RootPath)
-	if err != nil {
-		return 0, err
+func (driver *GitDriver) resolveAuthor() *object.Signature {
+	if driver.CommitAuthorResolver != nil {
+		if sig := driver.CommitAuthorResolver(driver.username); sig != nil {
+			return sig
+		}
 	}
-	tree, err := r.Worktree()
-	if err != nil {
-		return 0, err
+	return &object.Signature{
+		Name:  "John Doe",
+		Email: "john@doe.org",
+		When:  time.Now(),
 	}
+}
 
-	var isExist bool
-	f, err := tree.Filesystem.Lstat(destPath)
-	if err == nil {
-		isExist = true
-		if f.IsDir() {
-			return 0, errors.New("A dir has the same name")
+func (driver *GitDriver) PutFile(destPath string, data io.Reader, appendData bool) (int64, error) {
+	if isVirtualPath(destPath) {
+		return 0, errReadOnlyHistory(destPath)
+	}
+
+	var written int64
+	r, err := driver.withWriteLock(func(r *git.Repository) error {
+		tree, err := r.Worktree()
+		if err != nil {
+			return err
 		}
-	} else {
-		if os.IsNotExist(err) {
-			isExist = false
+
+		var isExist bool
+		f, err := tree.Filesystem.Lstat(destPath)
+		if err == nil {
+			isExist = true
+			if f.IsDir() {
+				return errors.New("A dir has the same name")
+			}
 		} else {
-			return 0, errors.New(fmt.Sprintln("Put File error:", err))
+			if os.IsNotExist(err) {
+				isExist = false
+			} else {
+				return errors.New(fmt.Sprintln("Put File error:", err))
+			}
 		}
-	}
 
-	if appendData && !isExist {
-		appendData = false
-	}
+		if appendData && !isExist {
+			appendData = false
+		}
 
-	if !appendData {
-		if isExist {
-			err = tree.Filesystem.Remove(destPath)
+		if !appendData {
+			if isExist {
+				if err := tree.Filesystem.Remove(destPath); err != nil {
+					return err
+				}
+			}
+			f, err := tree.Filesystem.Create(destPath)
 			if err != nil {
-				return 0, err
+				return err
 			}
+			defer f.Close()
+			written, err = io.Copy(f, data)
+			if err != nil {
+				return err
+			}
+
+			if err := driver.add(destPath, r); err != nil {
+				return err
+			}
+
+			return driver.commit(r, "put", destPath)
 		}
-		f, err := tree.Filesystem.Create(destPath)
-		if err != nil {
-			return 0, err
-		}
-		defer f.Close()
-		bytes, err := io.Copy(f, data)
+
+		of, err := tree.Filesystem.OpenFile(destPath, os.O_APPEND|os.O_RDWR, 0660)
 		if err != nil {
-			return 0, err
+			return err
 		}
+		defer of.Close()
 
-		err = driver.add(destPath, r)
-		if err != nil {
-			return 0, err
+		if _, err := of.Seek(0, os.SEEK_END); err != nil {
+			return err
 		}
 
-		err = driver.commit(r)
+		written, err = io.Copy(of, data)
 		if err != nil {
-			return 0, err
+			return err
 		}
 
-		return bytes, nil
-	}
+		if err := driver.add(destPath, r); err != nil {
+			return err
+		}
 
-	of, err := tree.Filesystem.OpenFile(destPath, os.O_APPEND|os.O_RDWR, 0660)
+		return driver.commit(r, "append", destPath)
+	})
 	if err != nil {
 		return 0, err
 	}
-	defer of.Close()
 
-	_, err = of.Seek(0, os.SEEK_END)
-	if err != nil {
-		return 0, err
+	if err := driver.syncAfterCommit(r); err != nil {
+		return written, err
 	}
+	return written, nil
+}
 
-	bytes, err := io.Copy(of, data)
-	if err != nil {
-		return 0, err
-	}
+type GitDriverFactory struct {
+	server.Perm
 
-	err = driver.add(destPath, r)
-	if err != nil {
-		return 0, err
-	}
+	// Backend supplies the repository this factory serves. See
+	// backend/plain, backend/memory and backend/clone for the shipped
+	// implementations.
+	Backend Backend
+
+	// CommitAuthorResolver, when set, maps the FTP username of each
+	// connection to the git signature its commits are attributed to.
+	CommitAuthorResolver CommitAuthorResolver
+
+	// RemoteName is the git remote synced with; defaults to "origin".
+	RemoteName string
+	// PushMode controls whether and how commits are mirrored to RemoteName.
+	// Defaults to PushOff.
+	PushMode PushMode
+	// SSHKeyPath and HTTPSToken configure auth for RemoteName; set at
+	// most one. Both empty means the remote must already accept
+	// anonymous access.
+	SSHKeyPath string
+	HTTPSToken string
+
+	syncOnce sync.Once
+	sync     *remoteSync
+
+	// repo and mu are opened/initialized once and shared by every
+	// driver this factory manufactures, so ListDir and friends don't
+	// re-read the dotgit on every FTP command, and concurrent sessions
+	// can't stomp on each other's commits.
+	backendOnce sync.Once
+	repo        *git.Repository
+	backendErr  error
+	mu          sync.RWMutex
+}
 
-	err = driver.commit(r)
-	if err != nil {
-		return 0, err
+// NewGitDriverFactory is a thin wrapper around backend/plain for callers
+// that just want to serve a local checkout, matching how
+// GitDriverFactory{RootPath: ...} used to be constructed directly.
+func NewGitDriverFactory(rootPath string, perm server.Perm) *GitDriverFactory {
+	return &GitDriverFactory{
+		Backend: plain.New(rootPath),
+		Perm:    perm,
 	}
+}
 
-	return bytes, nil
+// ensureSync lazily builds the shared remoteSync used by every driver
+// this factory manufactures, so the push queue and backoff state is
+// shared across FTP connections rather than duplicated per-driver.
+func (factory *GitDriverFactory) ensureSync() *remoteSync {
+	factory.syncOnce.Do(func() {
+		if factory.PushMode == PushOff {
+			return
+		}
+		s, err := newRemoteSync(&factory.mu, factory.RemoteName, factory.PushMode, factory.SSHKeyPath, factory.HTTPSToken)
+		if err != nil {
+			log.Printf("giftp: remote sync disabled: %v", err)
+			return
+		}
+		factory.sync = s
+	})
+	return factory.sync
 }
 
-type GitDriverFactory struct {
-	RootPath string
-	server.Perm
+// ensureBackend opens factory.Backend exactly once, regardless of how
+// many drivers are manufactured from this factory. If remote sync is
+// configured, it also pulls once here, when the repo is first opened,
+// rather than on every connection's Init: a pull needing a merge, or
+// racing a session's staged-but-uncommitted change, would otherwise risk
+// clobbering in-progress work every time a client connects.
+func (factory *GitDriverFactory) ensureBackend() (*git.Repository, error) {
+	factory.backendOnce.Do(func() {
+		if factory.Backend == nil {
+			factory.backendErr = errors.New("giftp: GitDriverFactory.Backend is required (see backend/plain, backend/memory, backend/clone)")
+			return
+		}
+		factory.repo, factory.backendErr = factory.Backend.Open()
+		if factory.backendErr == nil && factory.sync != nil {
+			factory.sync.init(factory.repo)
+		}
+	})
+	return factory.repo, factory.backendErr
 }
 
 func (factory *GitDriverFactory) NewDriver() (server.Driver, error) {
-	return &GitDriver{factory.RootPath, factory.Perm}, nil
+	sync := factory.ensureSync()
+	repo, err := factory.ensureBackend()
+	if err != nil {
+		return nil, err
+	}
+
+	return &GitDriver{
+		Perm:                 factory.Perm,
+		CommitAuthorResolver: factory.CommitAuthorResolver,
+		backend:              factory.Backend,
+		repo:                 repo,
+		mu:                   &factory.mu,
+		sync:                 sync,
+	}, nil
 }
@@ -0,0 +1,110 @@
+package giftp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/goftp/server"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// BenchmarkListDirLargeTree measures ListDir against a 10k-file tree.
+// Before the repository-caching refactor, every call reopened the
+// dotgit via git.PlainOpen; now the factory opens it once and drivers
+// share it under a RWMutex, so repeated ListDir calls should scale with
+// ReadDir cost alone rather than repo-open cost. See
+// BenchmarkListDirLargeTree_ReopenEachCall for the before/after baseline.
+func BenchmarkListDirLargeTree(b *testing.B) {
+	root := newBenchRepo(b, 10000)
+
+	factory := NewGitDriverFactory(root, server.NewSimplePerm("user", "group"))
+	d, err := factory.NewDriver()
+	if err != nil {
+		b.Fatal(err)
+	}
+	driver := d.(*GitDriver)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := driver.ListDir("/", func(server.FileInfo) error { return nil })
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkListDirLargeTree_ReopenEachCall reproduces the pre-refactor
+// behavior this package used to have: every ListDir re-opened the dotgit
+// from scratch instead of sharing one *git.Repository across calls. Run
+// alongside BenchmarkListDirLargeTree to see what the caching actually
+// bought:
+//
+//	go test -bench LargeTree -benchtime 100x
+func BenchmarkListDirLargeTree_ReopenEachCall(b *testing.B) {
+	root := newBenchRepo(b, 10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := git.PlainOpen(root)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tree, err := r.Worktree()
+		if err != nil {
+			b.Fatal(err)
+		}
+		files, err := tree.Filesystem.ReadDir("/")
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, f := range files {
+			if _, err := tree.Filesystem.Stat(f.Name()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// newBenchRepo creates a throwaway repository with n committed files and
+// registers its cleanup with b.
+func newBenchRepo(b *testing.B, n int) string {
+	b.Helper()
+
+	dir, err := ioutil.TempDir("", "giftp-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tree, err := r.Worktree()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file-%d.txt", i)
+		if err := ioutil.WriteFile(dir+"/"+name, []byte("x"), 0644); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tree.Add(name); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	_, err = tree.Commit("seed bench tree", &git.CommitOptions{
+		Author: &object.Signature{Name: "bench", Email: "bench@giftp", When: time.Now()},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return dir
+}
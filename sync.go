@@ -0,0 +1,177 @@
+package giftp
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// PushMode controls how (and whether) a GitDriverFactory mirrors local
+// commits to a remote.
+type PushMode int
+
+const (
+	// PushOff never touches the remote; the repository stays purely local.
+	PushOff PushMode = iota
+	// PushSync pushes inline with the commit, returning any push error
+	// to the FTP client that triggered it.
+	PushSync
+	// PushAsync queues the push and lets the FTP write return immediately.
+	PushAsync
+)
+
+const (
+	syncMaxRetries  = 5
+	syncBaseBackoff = 500 * time.Millisecond
+)
+
+// remoteSync pushes commits to a configured remote on behalf of every
+// driver a factory manufactures, and pulls once when the factory opens
+// its repo so a long-running FTP server starts current with changes
+// made elsewhere. Async pushes are queued so a slow or unreachable
+// remote never stalls an FTP write.
+type remoteSync struct {
+	// mu is the same lock GitDriver uses to guard the shared repo.
+	// Pushing mutates the repo's object store and remote-tracking refs,
+	// so both the inline (PushSync) and background (PushAsync) paths
+	// take it for the duration of the actual push, to avoid racing a
+	// concurrent FTP write against the same *git.Repository.
+	mu *sync.RWMutex
+
+	remoteName string
+	mode       PushMode
+	auth       transport.AuthMethod
+
+	queue chan *git.Repository
+	once  sync.Once
+}
+
+func newRemoteSync(mu *sync.RWMutex, remoteName string, mode PushMode, sshKeyPath, httpsToken string) (*remoteSync, error) {
+	if remoteName == "" {
+		remoteName = "origin"
+	}
+
+	auth, err := resolveRemoteAuth(sshKeyPath, httpsToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &remoteSync{
+		mu:         mu,
+		remoteName: remoteName,
+		mode:       mode,
+		auth:       auth,
+		queue:      make(chan *git.Repository, 64),
+	}, nil
+}
+
+// resolveRemoteAuth mirrors the auth styles used elsewhere for go-git:
+// an SSH private key file, or an HTTPS token carried as basic auth.
+func resolveRemoteAuth(sshKeyPath, httpsToken string) (transport.AuthMethod, error) {
+	switch {
+	case sshKeyPath != "":
+		return ssh.NewPublicKeysFromFile("git", sshKeyPath, "")
+	case httpsToken != "":
+		return &http.BasicAuth{Username: "giftp", Password: httpsToken}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// start spins up the background worker that drains the async push
+// queue. Safe to call repeatedly; only the first call has any effect.
+func (s *remoteSync) start() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		go s.worker()
+	})
+}
+
+func (s *remoteSync) worker() {
+	for r := range s.queue {
+		if err := s.pushWithRetry(r); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// afterCommit is invoked once a local commit has landed. PushSync pushes
+// inline and surfaces a push error to the caller; PushAsync enqueues the
+// push and returns immediately; PushOff is a no-op.
+func (s *remoteSync) afterCommit(r *git.Repository) error {
+	if s == nil || s.mode == PushOff {
+		return nil
+	}
+	if s.mode == PushSync {
+		return s.pushWithRetry(r)
+	}
+
+	s.start()
+	select {
+	case s.queue <- r:
+	default:
+		log.Printf("giftp: push queue to %q is full, dropping push", s.remoteName)
+	}
+	return nil
+}
+
+// pushWithRetry retries push attempts with exponential backoff, taking
+// driver.mu only around each individual push rather than for the whole
+// backoff period, so a slow or unreachable remote doesn't hold up other
+// FTP sessions between attempts.
+func (s *remoteSync) pushWithRetry(r *git.Repository) error {
+	backoff := syncBaseBackoff
+	var err error
+	for attempt := 1; attempt <= syncMaxRetries; attempt++ {
+		err = s.push(r)
+		if err == nil || err == git.NoErrAlreadyUpToDate {
+			return nil
+		}
+		log.Printf("giftp: push to %q failed (attempt %d/%d): %v", s.remoteName, attempt, syncMaxRetries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return fmt.Errorf("giftp: giving up pushing to %q: %w", s.remoteName, err)
+}
+
+// push sends r's commits to the remote. It holds mu for the duration of
+// the call: the background worker otherwise has nothing stopping it
+// from pushing while another FTP session is concurrently writing to the
+// same shared repository.
+func (s *remoteSync) push(r *git.Repository) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return r.Push(&git.PushOptions{RemoteName: s.remoteName, Auth: s.auth})
+}
+
+// init fetches and fast-forwards the worktree. Called once, when the
+// factory first opens its repo, not per-connection: by the time a
+// client connects the repo may already have sessions with staged
+// changes, and a pull here could collide with or clobber them.
+func (s *remoteSync) init(r *git.Repository) {
+	if s == nil || s.mode == PushOff {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tree, err := r.Worktree()
+	if err != nil {
+		log.Printf("giftp: sync init: %v", err)
+		return
+	}
+
+	err = tree.Pull(&git.PullOptions{RemoteName: s.remoteName, Auth: s.auth})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		log.Printf("giftp: pull from %q failed: %v", s.remoteName, err)
+	}
+}
@@ -0,0 +1,331 @@
+package giftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goftp/server"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Virtual top-level directories that expose git history read-only,
+// alongside the default working tree served at "/".
+const (
+	vfsBranches = "@branches"
+	vfsTags     = "@tags"
+	vfsCommits  = "@commits"
+)
+
+var vfsRoots = []string{vfsBranches, vfsTags, vfsCommits}
+
+// isVirtualPath reports whether path falls under one of the "@..."
+// history roots rather than the live working tree.
+func isVirtualPath(path string) bool {
+	_, _, _, ok := splitVirtualPath(path)
+	return ok
+}
+
+// splitVirtualPath breaks a path like "/@branches/main/sub/file.txt" into
+// its virtual root ("@branches"), the revision it names ("main") and the
+// path within that revision's tree ("sub/file.txt"). ok is false for any
+// path outside the virtual roots.
+func splitVirtualPath(path string) (kind, ref, rest string, ok bool) {
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return "", "", "", false
+	}
+	parts := strings.SplitN(trimmed, "/", 3)
+
+	for _, root := range vfsRoots {
+		if parts[0] != root {
+			continue
+		}
+		kind = root
+		if len(parts) > 1 {
+			ref = parts[1]
+		}
+		if len(parts) > 2 {
+			rest = parts[2]
+		}
+		return kind, ref, rest, true
+	}
+	return "", "", "", false
+}
+
+// errReadOnlyHistory is returned by every mutating operation attempted
+// against a virtual "@..." path.
+func errReadOnlyHistory(path string) error {
+	return fmt.Errorf("%s is part of git history and is read-only", path)
+}
+
+// virtualFileInfo implements server.FileInfo for entries synthesized
+// from git objects, which have no backing os.FileInfo of their own.
+type virtualFileInfo struct {
+	name    string
+	size    int64
+	isDir   bool
+	modTime time.Time
+	owner   string
+	group   string
+}
+
+func (fi *virtualFileInfo) Name() string       { return fi.name }
+func (fi *virtualFileInfo) Size() int64        { return fi.size }
+func (fi *virtualFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *virtualFileInfo) IsDir() bool        { return fi.isDir }
+func (fi *virtualFileInfo) Sys() interface{}   { return nil }
+func (fi *virtualFileInfo) Owner() string      { return fi.owner }
+func (fi *virtualFileInfo) Group() string      { return fi.group }
+
+func (fi *virtualFileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// virtualDirInfo synthesizes a directory entry for a virtual root or a
+// revision name, with no particular commit to attribute it to.
+func virtualDirInfo(name string) *virtualFileInfo {
+	return &virtualFileInfo{name: name, isDir: true, modTime: time.Now()}
+}
+
+// virtualEntryInfo synthesizes a FileInfo for a tree entry found inside
+// the given commit, stamping ModTime/owner/group from its committer.
+func virtualEntryInfo(name string, isDir bool, size int64, commit *object.Commit) *virtualFileInfo {
+	return &virtualFileInfo{
+		name:    name,
+		size:    size,
+		isDir:   isDir,
+		modTime: commit.Committer.When,
+		owner:   commit.Author.Name,
+		group:   commit.Author.Email,
+	}
+}
+
+// resolveVirtualCommit finds the commit a branch, tag or commit-prefix
+// revision under a virtual root points at.
+func resolveVirtualCommit(r *git.Repository, kind, ref string) (*object.Commit, error) {
+	switch kind {
+	case vfsBranches:
+		revision, err := r.Reference(plumbing.NewBranchReferenceName(ref), true)
+		if err != nil {
+			return nil, fmt.Errorf("unknown branch %q: %w", ref, err)
+		}
+		return r.CommitObject(revision.Hash())
+
+	case vfsTags:
+		tagRef, err := r.Tag(ref)
+		if err != nil {
+			return nil, fmt.Errorf("unknown tag %q: %w", ref, err)
+		}
+		if tagObj, err := r.TagObject(tagRef.Hash()); err == nil {
+			return tagObj.Commit()
+		}
+		// Lightweight tags point straight at the commit.
+		return r.CommitObject(tagRef.Hash())
+
+	case vfsCommits:
+		return resolveCommitByPrefix(r, ref)
+
+	default:
+		return nil, fmt.Errorf("unknown virtual root %q", kind)
+	}
+}
+
+// resolveCommitByPrefix resolves a (possibly abbreviated) commit sha.
+// Ambiguous prefixes are rejected rather than silently picking one.
+func resolveCommitByPrefix(r *git.Repository, prefix string) (*object.Commit, error) {
+	if len(prefix) == 40 {
+		return r.CommitObject(plumbing.NewHash(prefix))
+	}
+
+	iter, err := r.CommitObjects()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var found *object.Commit
+	err = iter.ForEach(func(c *object.Commit) error {
+		if !strings.HasPrefix(c.Hash.String(), prefix) {
+			return nil
+		}
+		if found != nil {
+			return fmt.Errorf("commit prefix %q is ambiguous", prefix)
+		}
+		found = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no commit matches prefix %q", prefix)
+	}
+	return found, nil
+}
+
+// virtualStat resolves a path under a virtual root to a FileInfo,
+// without requiring the caller to know in advance whether it names a
+// root, a revision, a directory inside a tree, or a file.
+func virtualStat(r *git.Repository, path string) (server.FileInfo, error) {
+	kind, ref, rest, ok := splitVirtualPath(path)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a virtual path", path)
+	}
+	if ref == "" {
+		return virtualDirInfo(kind), nil
+	}
+
+	commit, err := resolveVirtualCommit(r, kind, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	rest = strings.Trim(rest, "/")
+	if rest == "" {
+		return virtualEntryInfo(ref, true, 0, commit), nil
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := tree.FindEntry(rest)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.Mode.IsFile() {
+		return virtualEntryInfo(entry.Name, true, 0, commit), nil
+	}
+	file, err := tree.TreeEntryFile(entry)
+	if err != nil {
+		return nil, err
+	}
+	return virtualEntryInfo(entry.Name, false, file.Size, commit), nil
+}
+
+// virtualListDir lists the children of a virtual path: the known
+// revisions under a root, or the entries of a tree once a revision has
+// been resolved. "/" itself is not a virtual path; GitDriver.ListDir adds
+// the three roots to the working tree's listing there.
+func virtualListDir(r *git.Repository, path string, callback func(server.FileInfo) error) error {
+	kind, ref, rest, ok := splitVirtualPath(path)
+	if !ok {
+		return fmt.Errorf("%s is not a virtual path", path)
+	}
+
+	if ref == "" {
+		return virtualListRevisions(r, kind, callback)
+	}
+
+	commit, err := resolveVirtualCommit(r, kind, ref)
+	if err != nil {
+		return err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	rest = strings.Trim(rest, "/")
+	if rest != "" {
+		tree, err = tree.Tree(rest)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range tree.Entries {
+		isDir := !entry.Mode.IsFile()
+		var size int64
+		if !isDir {
+			if file, err := tree.TreeEntryFile(&entry); err == nil {
+				size = file.Size
+			}
+		}
+		if err := callback(virtualEntryInfo(entry.Name, isDir, size, commit)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func virtualListRevisions(r *git.Repository, kind string, callback func(server.FileInfo) error) error {
+	switch kind {
+	case vfsBranches:
+		refs, err := r.Branches()
+		if err != nil {
+			return err
+		}
+		defer refs.Close()
+		return refs.ForEach(func(ref *plumbing.Reference) error {
+			return callback(virtualDirInfo(ref.Name().Short()))
+		})
+
+	case vfsTags:
+		refs, err := r.Tags()
+		if err != nil {
+			return err
+		}
+		defer refs.Close()
+		return refs.ForEach(func(ref *plumbing.Reference) error {
+			return callback(virtualDirInfo(ref.Name().Short()))
+		})
+
+	case vfsCommits:
+		head, err := r.Head()
+		if err != nil {
+			return err
+		}
+		iter, err := r.Log(&git.LogOptions{From: head.Hash()})
+		if err != nil {
+			return err
+		}
+		defer iter.Close()
+		return iter.ForEach(func(c *object.Commit) error {
+			return callback(virtualEntryInfo(c.Hash.String()[:12], true, 0, c))
+		})
+
+	default:
+		return fmt.Errorf("unknown virtual root %q", kind)
+	}
+}
+
+// virtualGetFile reads a file's contents out of the tree a revision
+// points at.
+func virtualGetFile(r *git.Repository, path string, offset int64) (int64, io.ReadCloser, error) {
+	kind, ref, rest, ok := splitVirtualPath(path)
+	if !ok {
+		return 0, nil, fmt.Errorf("%s is not a virtual path", path)
+	}
+
+	commit, err := resolveVirtualCommit(r, kind, ref)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	file, err := commit.File(strings.Trim(rest, "/"))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rc, err := file.Reader()
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset > 0 {
+		if _, err := io.CopyN(io.Discard, rc, offset); err != nil {
+			rc.Close()
+			return 0, nil, err
+		}
+	}
+
+	return file.Size, rc, nil
+}